@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// checkpoint is the on-disk representation written to -checkpointFile, so a
+// crashed or killed run can be resumed with -skipUntil without the user having
+// to watch the logs for "you can resume from there".
+type checkpoint struct {
+	Timestamp     time.Time `json:"timestamp"`
+	WhisperDir    string    `json:"whisperDir"`
+	Include       string    `json:"include"`
+	Exclude       string    `json:"exclude"`
+	SkipUntil     string    `json:"skipUntil"`
+	FilesRead     uint64    `json:"filesRead"`
+	PointsWritten uint64    `json:"pointsWritten"`
+}
+
+// writeCheckpoint atomically writes cp to path via write-to-temp-then-rename,
+// so a reader (or a crash mid-write) never observes a half-written file.
+func writeCheckpoint(path string, cp checkpoint) error {
+	data, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readCheckpoint loads a checkpoint previously written by writeCheckpoint.
+func readCheckpoint(path string) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+// matches reports whether cp was written for the same whisperDir/include/exclude
+// filters as the current run, i.e. whether it's safe to resume from it.
+func (cp *checkpoint) matches(whisperDir, include, exclude string) bool {
+	return cp.WhisperDir == whisperDir && cp.Include == include && cp.Exclude == exclude
+}
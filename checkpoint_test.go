@@ -0,0 +1,66 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestWriteReadCheckpointRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	want := checkpoint{
+		Timestamp:     time.Unix(1700000000, 0).UTC(),
+		WhisperDir:    "/data/whisper",
+		Include:       "servers",
+		Exclude:       "tmp",
+		SkipUntil:     "/data/whisper/servers/web01/cpu.wsp",
+		FilesRead:     42,
+		PointsWritten: 1234,
+	}
+	if err := writeCheckpoint(path, want); err != nil {
+		t.Fatalf("writeCheckpoint: %s", err)
+	}
+
+	got, err := readCheckpoint(path)
+	if err != nil {
+		t.Fatalf("readCheckpoint: %s", err)
+	}
+	if !got.Timestamp.Equal(want.Timestamp) || got.WhisperDir != want.WhisperDir ||
+		got.Include != want.Include || got.Exclude != want.Exclude ||
+		got.SkipUntil != want.SkipUntil || got.FilesRead != want.FilesRead ||
+		got.PointsWritten != want.PointsWritten {
+		t.Errorf("readCheckpoint() = %+v, want %+v", got, want)
+	}
+}
+
+func TestWriteCheckpointLeavesNoTempFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.json")
+	if err := writeCheckpoint(path, checkpoint{}); err != nil {
+		t.Fatalf("writeCheckpoint: %s", err)
+	}
+	if _, err := readCheckpoint(path + ".tmp"); err == nil {
+		t.Error("expected the .tmp file to be gone after the atomic rename")
+	}
+}
+
+func TestReadCheckpointMissingFile(t *testing.T) {
+	if _, err := readCheckpoint(filepath.Join(t.TempDir(), "does-not-exist.json")); err == nil {
+		t.Error("expected an error reading a checkpoint that was never written")
+	}
+}
+
+func TestCheckpointMatches(t *testing.T) {
+	cp := checkpoint{WhisperDir: "/data/whisper", Include: "servers", Exclude: "tmp"}
+	if !cp.matches("/data/whisper", "servers", "tmp") {
+		t.Error("matches() = false for identical whisperDir/include/exclude")
+	}
+	if cp.matches("/data/other", "servers", "tmp") {
+		t.Error("matches() = true for a different whisperDir")
+	}
+	if cp.matches("/data/whisper", "other", "tmp") {
+		t.Error("matches() = true for a different include filter")
+	}
+	if cp.matches("/data/whisper", "servers", "other") {
+		t.Error("matches() = true for a different exclude filter")
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/kisielk/whisper-go/whisper"
+)
+
+// TestDedupArchivesPrefersHigherResolution builds a two-archive whisper file
+// (1s/20pts fine archive, 10s/40pts coarse archive) the way a real whisper
+// file ends up after rollups: recent history duplicated into both archives,
+// older history only in the coarse one. dedupArchives should keep the
+// fine-grained points for anything the fine archive covers, and only fall
+// back to the coarse archive for timestamps older than that.
+func TestDedupArchivesPrefersHigherResolution(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "metric.wsp")
+	w, err := whisper.Create(path, []whisper.ArchiveInfo{
+		whisper.NewArchiveInfo(1, 20),
+		whisper.NewArchiveInfo(10, 40),
+	}, whisper.DefaultCreateOptions())
+	if err != nil {
+		t.Fatalf("whisper.Create: %s", err)
+	}
+	defer w.Close()
+
+	now := time.Now()
+
+	// write 10 consecutive 1s points (spanning one or two 10s coarse buckets,
+	// depending on alignment) so the recent range is rolled up into the coarse
+	// archive as well
+	recent := make([]whisper.Point, 0, 10)
+	for i := 10; i >= 1; i-- {
+		recent = append(recent, whisper.NewPoint(now.Add(-time.Duration(i)*time.Second), float64(i)))
+	}
+	for _, p := range recent {
+		if err := w.Update(p); err != nil {
+			t.Fatalf("Update(%+v): %s", p, err)
+		}
+	}
+
+	// older than the fine archive's 20s retention, but within the coarse
+	// archive's 400s retention - only the coarse archive can hold this
+	oldPoint := whisper.NewPoint(now.Add(-200*time.Second), 42)
+	if err := w.Update(oldPoint); err != nil {
+		t.Fatalf("Update(%+v): %s", oldPoint, err)
+	}
+
+	points := dedupArchives(w, path)
+
+	if len(points) == 0 {
+		t.Fatal("dedupArchives returned no points")
+	}
+	for i := 1; i < len(points); i++ {
+		if points[i].Timestamp < points[i-1].Timestamp {
+			t.Fatalf("points not sorted by timestamp: %+v before %+v", points[i-1], points[i])
+		}
+	}
+
+	oldestTs := points[0].Timestamp
+	wantOldest := uint32(oldPoint.Timestamp / 10 * 10) // quantized to the coarse archive's 10s precision
+	if oldestTs != wantOldest {
+		t.Errorf("oldest point timestamp = %d, want %d (the coarse-archive-only point)", oldestTs, wantOldest)
+	}
+
+	// every point at or after the fine archive's earliest timestamp must
+	// come from the fine archive's 1-second grid, not a coarse 10s bucket
+	// that duplicates it
+	fineEarliest := recent[0].Timestamp
+	seenFineRange := 0
+	for _, p := range points {
+		if p.Timestamp >= fineEarliest {
+			seenFineRange++
+		}
+	}
+	if seenFineRange != len(recent) {
+		t.Errorf("got %d points at/after the fine archive's range, want %d (one per second, no coarse duplicate)", seenFineRange, len(recent))
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileLineWriterSink writes points as plain text to a file (or stdout, with
+// path "" or "-"), making the tool usable as a pure whisper-to-line-protocol
+// or whisper-to-text-exposition converter for offline pipelines, with no
+// database in the loop at all. Write/Close share a single *bufio.Writer, so
+// mu guards against the concurrent calls the Sink interface requires support for.
+type fileLineWriterSink struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	closer io.Closer
+	format string // "influx" (line protocol) or "prometheus" (text exposition)
+}
+
+func newFileLineWriterSink(path, format string) (*fileLineWriterSink, error) {
+	if format != "influx" && format != "prometheus" {
+		return nil, fmt.Errorf("-fileLineWriterFormat must be \"influx\" or \"prometheus\", got %q", format)
+	}
+	var out io.Writer
+	var closer io.Closer
+	if path == "" || path == "-" {
+		out = os.Stdout
+	} else {
+		f, err := os.Create(path)
+		if err != nil {
+			return nil, err
+		}
+		out, closer = f, f
+	}
+	return &fileLineWriterSink{w: bufio.NewWriter(out), closer: closer, format: format}, nil
+}
+
+func (s *fileLineWriterSink) Write(points []seriesPoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, p := range points {
+		var line string
+		if s.format == "prometheus" {
+			line = prometheusLine(p)
+		} else {
+			line = influxLine(p)
+		}
+		if _, err := s.w.WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+	return s.w.Flush()
+}
+
+func (s *fileLineWriterSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.closer != nil {
+		return s.closer.Close()
+	}
+	return nil
+}
+
+// sortedTags renders tags as "k=v,k=v" (sorted by key, for deterministic
+// output), using format to quote each value.
+func sortedTags(tags map[string]string, format string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf(format, k, tags[k])
+	}
+	return strings.Join(parts, ",")
+}
+
+// influxLine renders p as a single InfluxDB line protocol line.
+func influxLine(p seriesPoint) string {
+	tags := sortedTags(p.Tags, "%s=%s")
+	if tags != "" {
+		tags = "," + tags
+	}
+	return fmt.Sprintf("%s%s %s=%v %d", p.Measurement, tags, p.Field, p.Value, p.Time.UnixNano())
+}
+
+// prometheusLine renders p as a single Prometheus text-exposition line.
+func prometheusLine(p seriesPoint) string {
+	labels := sortedTags(p.Tags, "%s=%q")
+	return fmt.Sprintf("%s{%s} %v %d", p.Measurement, labels, p.Value, p.Time.UnixNano()/int64(time.Millisecond))
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// Backoff computes exponential backoff durations with optional jitter,
+// modeled on the retry/backoff pattern used in resilient upload clients.
+// It is not safe for concurrent use; each influxWorker keeps its own.
+type Backoff struct {
+	Min         time.Duration
+	Max         time.Duration
+	Factor      float64
+	Jitter      bool
+	MaxAttempts int // 0 means unlimited
+
+	attempt int
+}
+
+// Duration returns the backoff duration for the current attempt and advances
+// the attempt counter.
+func (b *Backoff) Duration() time.Duration {
+	d := float64(b.Min) * math.Pow(b.Factor, float64(b.attempt))
+	if d > float64(b.Max) {
+		d = float64(b.Max)
+	}
+	b.attempt++
+	if b.Jitter {
+		d = rand.Float64() * d
+	}
+	if d < float64(b.Min) {
+		d = float64(b.Min)
+	}
+	return time.Duration(d)
+}
+
+// Reset zeroes the attempt counter, so the Backoff can be reused for the next
+// streak of errors.
+func (b *Backoff) Reset() {
+	b.attempt = 0
+}
+
+// Exhausted reports whether MaxAttempts has been reached.
+func (b *Backoff) Exhausted() bool {
+	return b.MaxAttempts > 0 && b.attempt >= b.MaxAttempts
+}
+
+// errClass categorizes a write error so we know whether retrying it is worth it.
+type errClass string
+
+const (
+	errClass4xx     errClass = "4xx"
+	errClass5xx     errClass = "5xx"
+	errClassNetwork errClass = "network"
+)
+
+// statusCoder is implemented by write errors that carry the real HTTP status
+// code (see writeStatusErr in sink.go). Errors that don't implement it - a
+// dial timeout, connection refused, a sink that can't report one - are
+// treated as network-level failures by classifyWriteErr.
+type statusCoder interface {
+	StatusCode() int
+}
+
+// classifyWriteErr categorizes a failed write so we know whether retrying it
+// is worth it. Anything without a real status code is treated as a
+// network-level error (timeouts, connection refused, DNS failures, etc).
+func classifyWriteErr(err error) errClass {
+	sc, ok := err.(statusCoder)
+	if !ok {
+		return errClassNetwork
+	}
+	switch code := sc.StatusCode(); {
+	case code >= 400 && code < 500:
+		return errClass4xx
+	case code >= 500 && code < 600:
+		return errClass5xx
+	default:
+		return errClassNetwork
+	}
+}
+
+// parseRetryOn turns a comma separated -retryOn value (e.g. "5xx,network")
+// into a set of classes that are worth retrying. 4xx is deliberately not
+// accepted here: it always fails (or is skipped) immediately, since retrying
+// a malformed request never helps.
+func parseRetryOn(spec string) map[errClass]bool {
+	classes := make(map[errClass]bool)
+	for _, part := range strings.Split(spec, ",") {
+		switch errClass(strings.TrimSpace(part)) {
+		case errClass5xx:
+			classes[errClass5xx] = true
+		case errClassNetwork:
+			classes[errClassNetwork] = true
+		}
+	}
+	return classes
+}
+
+// shouldRetry reports whether err is worth retrying, given the configured
+// -retryOn classes. 4xx errors are never retried.
+func shouldRetry(err error, retryOn map[errClass]bool) bool {
+	class := classifyWriteErr(err)
+	if class == errClass4xx {
+		return false
+	}
+	return retryOn[class]
+}
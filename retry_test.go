@@ -0,0 +1,135 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDuration(t *testing.T) {
+	b := &Backoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, Factor: 2, Jitter: false}
+	want := []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond, 80 * time.Millisecond, 100 * time.Millisecond, 100 * time.Millisecond}
+	for i, w := range want {
+		if got := b.Duration(); got != w {
+			t.Errorf("attempt %d: Duration() = %s, want %s", i, got, w)
+		}
+	}
+}
+
+func TestBackoffDurationJitterStaysInRange(t *testing.T) {
+	b := &Backoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, Factor: 2, Jitter: true}
+	for i := 0; i < 20; i++ {
+		d := b.Duration()
+		if d < b.Min || d > b.Max {
+			t.Fatalf("attempt %d: Duration() = %s, want within [%s, %s]", i, d, b.Min, b.Max)
+		}
+	}
+}
+
+func TestBackoffReset(t *testing.T) {
+	b := &Backoff{Min: 10 * time.Millisecond, Max: 100 * time.Millisecond, Factor: 2, Jitter: false}
+	b.Duration()
+	b.Duration()
+	b.Reset()
+	if got := b.Duration(); got != b.Min {
+		t.Errorf("Duration() after Reset() = %s, want %s", got, b.Min)
+	}
+}
+
+func TestBackoffExhausted(t *testing.T) {
+	b := &Backoff{Min: time.Millisecond, Max: time.Millisecond, MaxAttempts: 3}
+	for i := 0; i < 3; i++ {
+		if b.Exhausted() {
+			t.Fatalf("Exhausted() = true before MaxAttempts reached, attempt %d", i)
+		}
+		b.Duration()
+	}
+	if !b.Exhausted() {
+		t.Error("Exhausted() = false after MaxAttempts reached")
+	}
+}
+
+func TestBackoffExhaustedUnlimited(t *testing.T) {
+	b := &Backoff{Min: time.Millisecond, Max: time.Millisecond, MaxAttempts: 0}
+	for i := 0; i < 100; i++ {
+		b.Duration()
+	}
+	if b.Exhausted() {
+		t.Error("Exhausted() = true with MaxAttempts 0 (unlimited)")
+	}
+}
+
+type fakeStatusErr int
+
+func (e fakeStatusErr) Error() string   { return "fake status error" }
+func (e fakeStatusErr) StatusCode() int { return int(e) }
+
+func TestClassifyWriteErr(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want errClass
+	}{
+		{"400 is a 4xx", fakeStatusErr(400), errClass4xx},
+		{"404 is a 4xx", fakeStatusErr(404), errClass4xx},
+		{"499 is a 4xx", fakeStatusErr(499), errClass4xx},
+		{"500 is a 5xx", fakeStatusErr(500), errClass5xx},
+		{"503 is a 5xx", fakeStatusErr(503), errClass5xx},
+		{"599 is a 5xx", fakeStatusErr(599), errClass5xx},
+		{"300 is neither, falls back to network", fakeStatusErr(300), errClassNetwork},
+		{"an error with no status code is network", errPlain{"connection refused"}, errClassNetwork},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := classifyWriteErr(c.err); got != c.want {
+				t.Errorf("classifyWriteErr(%v) = %s, want %s", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+type errPlain struct{ msg string }
+
+func (e errPlain) Error() string { return e.msg }
+
+func TestParseRetryOn(t *testing.T) {
+	cases := []struct {
+		spec string
+		want map[errClass]bool
+	}{
+		{"", map[errClass]bool{}},
+		{"5xx", map[errClass]bool{errClass5xx: true}},
+		{"network", map[errClass]bool{errClassNetwork: true}},
+		{"5xx,network", map[errClass]bool{errClass5xx: true, errClassNetwork: true}},
+		{" 5xx , network ", map[errClass]bool{errClass5xx: true, errClassNetwork: true}},
+		{"4xx", map[errClass]bool{}}, // 4xx is never accepted - see parseRetryOn's doc comment
+		{"bogus", map[errClass]bool{}},
+	}
+	for _, c := range cases {
+		got := parseRetryOn(c.spec)
+		if len(got) != len(c.want) {
+			t.Errorf("parseRetryOn(%q) = %#v, want %#v", c.spec, got, c.want)
+			continue
+		}
+		for class := range c.want {
+			if !got[class] {
+				t.Errorf("parseRetryOn(%q) missing class %s", c.spec, class)
+			}
+		}
+	}
+}
+
+func TestShouldRetry(t *testing.T) {
+	retryOn := parseRetryOn("5xx,network")
+	if shouldRetry(fakeStatusErr(400), retryOn) {
+		t.Error("shouldRetry() = true for a 4xx, want false - 4xx is never retried")
+	}
+	if !shouldRetry(fakeStatusErr(500), retryOn) {
+		t.Error("shouldRetry() = false for a 5xx with -retryOn 5xx,network")
+	}
+	if !shouldRetry(errPlain{"dial tcp: connection refused"}, retryOn) {
+		t.Error("shouldRetry() = false for a network error with -retryOn 5xx,network")
+	}
+	if shouldRetry(fakeStatusErr(500), parseRetryOn("network")) {
+		t.Error("shouldRetry() = true for a 5xx with -retryOn network only")
+	}
+}
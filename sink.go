@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// seriesPoint is sink-agnostic: one value at one point in time, with its
+// measurement name and tags already resolved by templating (see template.go).
+type seriesPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Field       string
+	Value       float64
+	Time        time.Time
+}
+
+// Sink is a pluggable output backend for whisper data, selected via -sink.
+// Write is called once per flushed batch (see influxWorker) and, since each
+// worker owns its own batch, may be called concurrently from multiple
+// goroutines - implementations must be safe for that.
+type Sink interface {
+	Write(points []seriesPoint) error
+	Close() error
+}
+
+// writeStatusErr wraps a failed write with the real HTTP status code the
+// server returned, so classifyWriteErr (retry.go) can tell a 4xx from a 5xx
+// instead of guessing from the error text. Sinks that talk HTTP directly
+// should return one of these for non-2xx responses.
+type writeStatusErr struct {
+	Code int
+	Body string
+}
+
+func (e *writeStatusErr) Error() string {
+	return fmt.Sprintf("write failed with status %d: %s", e.Code, e.Body)
+}
+
+func (e *writeStatusErr) StatusCode() int {
+	return e.Code
+}
+
+// newSink builds the Sink selected by -sink.
+func newSink(kind string) (Sink, error) {
+	switch kind {
+	case "", "influxdb":
+		return newInfluxSink(influxHost, influxPort, influxUser, influxPass, influxDb, influxRetentionPolicy, influxPrecision), nil
+	case "prom-remote-write":
+		return newPromRemoteWriteSink(promRemoteWriteURL, promRemoteWriteBearerToken, promRemoteWriteUser, promRemoteWritePass)
+	case "file-linewriter":
+		return newFileLineWriterSink(fileLineWriterPath, fileLineWriterFormat)
+	default:
+		return nil, fmt.Errorf("unknown -sink %q: must be one of influxdb, prom-remote-write, file-linewriter", kind)
+	}
+}
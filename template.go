@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// graphiteTemplate is one -template rule: an optional filter prefix selecting
+// which dotted metric names it applies to, and the dot-separated parts
+// describing how to turn the rest of the name into an InfluxDB measurement
+// plus tags. Modeled on Telegraf's graphite input templates.
+//
+// Each part is one of:
+//   - "*"             skip this path component, it becomes neither tag nor measurement
+//   - "measurement*"  join this component and everything after it into the measurement name
+//   - "measurement"   use this single component as the measurement name
+//   - anything else   becomes a tag with that name, set to this component's value
+type graphiteTemplate struct {
+	Filter string
+	Parts  []string
+}
+
+// apply matches a dotted metric name's components against the template,
+// returning the measurement name and extracted tags. ok is false if the
+// template doesn't have enough components to match.
+func (tpl graphiteTemplate) apply(components []string) (measurement string, tags map[string]string, ok bool) {
+	tags = make(map[string]string)
+	var measurementParts []string
+	for i, part := range tpl.Parts {
+		if i >= len(components) {
+			return "", nil, false
+		}
+		if part == "measurement*" {
+			measurementParts = components[i:]
+			break
+		}
+		switch part {
+		case "*":
+			// skip
+		case "measurement":
+			measurementParts = []string{components[i]}
+		default:
+			tags[part] = components[i]
+		}
+	}
+	if measurementParts == nil {
+		return "", nil, false
+	}
+	return strings.Join(measurementParts, "."), tags, true
+}
+
+// matchesFilter reports whether name falls under tpl.Filter, a dotted prefix
+// with its trailing wildcard already stripped by Set (so "servers.*" is
+// stored as "servers"). The match is by path component, not by raw string
+// prefix, so "servers" matches "servers.web01" but not "serversXYZ".
+func (tpl graphiteTemplate) matchesFilter(name string) bool {
+	return name == tpl.Filter || strings.HasPrefix(name, tpl.Filter+".")
+}
+
+// matchTemplate finds the first template whose filter matches name and that
+// has enough components to apply, and returns the measurement/tags it
+// produces. If none match, name is used as-is for the measurement, with no
+// extra tags.
+func matchTemplate(name string, templates []graphiteTemplate) (measurement string, tags map[string]string) {
+	components := strings.Split(name, ".")
+	for _, tpl := range templates {
+		if tpl.Filter != "" && !tpl.matchesFilter(name) {
+			continue
+		}
+		if m, t, ok := tpl.apply(components); ok {
+			return m, t
+		}
+	}
+	return name, map[string]string{}
+}
+
+// templateList implements flag.Value so -template can be repeated on the
+// command line, one flag occurrence per template rule.
+type templateList []graphiteTemplate
+
+func (t *templateList) String() string {
+	parts := make([]string, len(*t))
+	for i, tpl := range *t {
+		parts[i] = strings.TrimSpace(tpl.Filter + " " + strings.Join(tpl.Parts, "."))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Set parses a "[filter] part.part.part" template rule, e.g.
+// "servers.* host.resource.measurement*".
+func (t *templateList) Set(value string) error {
+	fields := strings.Fields(value)
+	var filter, partsField string
+	switch len(fields) {
+	case 1:
+		partsField = fields[0]
+	case 2:
+		filter, partsField = fields[0], fields[1]
+	default:
+		return fmt.Errorf("invalid -template %q: expected \"[filter] part.part.part\"", value)
+	}
+	// filters are written as a wildcard prefix (e.g. "servers.*"), but matching
+	// is by dotted path component rather than literal string, so the trailing
+	// wildcard is just punctuation - strip it down to the literal prefix
+	filter = strings.TrimSuffix(filter, "*")
+	filter = strings.TrimSuffix(filter, ".")
+	*t = append(*t, graphiteTemplate{
+		Filter: filter,
+		Parts:  strings.Split(partsField, "."),
+	})
+	return nil
+}
+
+// parseDefaultTags parses a comma separated "key=value,key=value" string, as
+// taken by -defaultTags, into a tag map merged into every point.
+func parseDefaultTags(spec string) map[string]string {
+	tags := make(map[string]string)
+	if spec == "" {
+		return tags
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags
+}
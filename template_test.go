@@ -0,0 +1,101 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatchTemplate(t *testing.T) {
+	cases := []struct {
+		name            string
+		metricName      string
+		templates       []string // fed through templateList.Set, in order
+		wantMeasurement string
+		wantTags        map[string]string
+	}{
+		{
+			name:            "filter matches by path component, not literal substring",
+			metricName:      "servers.web01.cpu.user",
+			templates:       []string{"servers.* host.resource.measurement*"},
+			wantMeasurement: "cpu.user",
+			wantTags:        map[string]string{"host": "servers", "resource": "web01"},
+		},
+		{
+			name:            "filter must match a full component, not just a prefix of one",
+			metricName:      "serversrack.cpu.user",
+			templates:       []string{"servers.* host.resource.measurement*"},
+			wantMeasurement: "serversrack.cpu.user",
+			wantTags:        map[string]string{},
+		},
+		{
+			name:            "no filter applies to every name",
+			metricName:      "servers.web01.cpu.user",
+			templates:       []string{"host.resource.measurement*"},
+			wantMeasurement: "cpu.user",
+			wantTags:        map[string]string{"host": "servers", "resource": "web01"},
+		},
+		{
+			name:            "first matching template wins",
+			metricName:      "servers.web01.cpu.user",
+			templates:       []string{"servers.* measurement", "servers.* host.resource.measurement*"},
+			wantMeasurement: "servers",
+			wantTags:        map[string]string{},
+		},
+		{
+			name:            "too few components to apply falls through to the next template",
+			metricName:      "servers.web01.cpu.user",
+			templates:       []string{"servers.* host.resource.environment.zone.measurement*", "servers.* host.resource.measurement*"},
+			wantMeasurement: "cpu.user",
+			wantTags:        map[string]string{"host": "servers", "resource": "web01"},
+		},
+		{
+			name:            "no template matches at all leaves name untouched",
+			metricName:      "servers.web01.cpu.user",
+			templates:       []string{"other.* host.resource.measurement*"},
+			wantMeasurement: "servers.web01.cpu.user",
+			wantTags:        map[string]string{},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var list templateList
+			for _, spec := range c.templates {
+				if err := list.Set(spec); err != nil {
+					t.Fatalf("Set(%q): %s", spec, err)
+				}
+			}
+			measurement, tags := matchTemplate(c.metricName, list)
+			if measurement != c.wantMeasurement {
+				t.Errorf("measurement = %q, want %q", measurement, c.wantMeasurement)
+			}
+			if !reflect.DeepEqual(tags, c.wantTags) {
+				t.Errorf("tags = %#v, want %#v", tags, c.wantTags)
+			}
+		})
+	}
+}
+
+func TestTemplateSetInvalid(t *testing.T) {
+	var list templateList
+	if err := list.Set("a b c"); err == nil {
+		t.Fatal("expected an error for a template with more than two fields")
+	}
+}
+
+func TestParseDefaultTags(t *testing.T) {
+	cases := []struct {
+		spec string
+		want map[string]string
+	}{
+		{"", map[string]string{}},
+		{"dc=us-east,env=prod", map[string]string{"dc": "us-east", "env": "prod"}},
+		{"malformed", map[string]string{}},
+	}
+	for _, c := range cases {
+		got := parseDefaultTags(c.spec)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseDefaultTags(%q) = %#v, want %#v", c.spec, got, c.want)
+		}
+	}
+}
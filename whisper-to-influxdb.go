@@ -3,15 +3,18 @@ package main
 import (
 	"flag"
 	"fmt"
-	"github.com/influxdb/influxdb/client"
 	"github.com/kisielk/whisper-go/whisper"
 	"github.com/rcrowley/go-metrics"
 	"log"
-	"net/url"
+	"math/rand"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 )
 
@@ -27,39 +30,66 @@ var influxSeries chan *abstractSerie
 
 var influxHost, influxUser, influxPass, influxDb string
 var influxPort uint
-
-var influxClient *client.Client
+var influxBatchSize int
+var influxBatchInterval time.Duration
+var influxPrecision string
+var influxRetentionPolicy string
+
+var retryMin, retryMax time.Duration
+var retryFactor float64
+var retryAttempts int
+var retryOn string
+var retryOnClasses map[errClass]bool
+var simulateFailureRate float64
+
+var sinkKind string
+var activeSink Sink
+var promRemoteWriteURL string
+var promRemoteWriteBearerToken string
+var promRemoteWriteUser string
+var promRemoteWritePass string
+var fileLineWriterPath string
+var fileLineWriterFormat string
 
 var whisperReadTimer metrics.Timer
 var influxWriteTimer metrics.Timer
+var influxWriteDropped metrics.Counter
 
 var skipUntil string
 var skipCounter uint64
 
 var influxPrefix string
+var graphiteTemplates templateList
+var defaultTagsSpec string
+var defaultTags map[string]string
+var fieldName string
 var include, exclude string
 var verbose bool
 var all bool
+var allDedup bool
 var skipInfluxErrors bool
 var skipWhisperErrors bool
 
 var statsInterval uint
 var exit chan int
 
-func seriesString(s *client.BatchPoints) string {
-	name := ""
-	if len(s.Points) > 0 {
-		name = s.Points[0].Measurement
-	}
-	return fmt.Sprintf("InfluxDB series '%s' (%d points)", name, len(s.Points))
-}
+var checkpointFile string
+var checkpointInterval time.Duration
+var stopWalk chan struct{}
+var errStopWalk = fmt.Errorf("stopped by signal")
+
+var filesReadCounter uint64
+var pointsWrittenCounter uint64
 
 // needed to keep track of what's the next file in line that needs processing
 // because the workers can finish out of order, relative to the order
 // of the filesystem walk which uses inode order.
 // this ensures if you use skipUntil, it resumes from the right pos, without forgetting any
 // other files that also needed processing.
-func keepOrder() {
+// it also owns writing -checkpointFile, since firstInProgress is exactly what
+// goes into it, and handles SIGINT/SIGTERM by checkpointing and letting the
+// walk stop cleanly instead of exiting abruptly.
+func keepOrder(sigChan <-chan os.Signal) {
 	type inProgress struct {
 		Path string
 		Next *inProgress
@@ -68,6 +98,47 @@ func keepOrder() {
 	// we keep a list, the InProgress list, like so : A-B-C-D-E-F
 	// the order of that list, is the inode/filesystem order
 
+	// lastFinished is the most recently finished path, used as the checkpoint's
+	// SkipUntil whenever the in-progress list is momentarily empty (the walk
+	// fell behind the worker pool, or just paused between bursts of matching
+	// files) - without it, a checkpoint ticking during such a lull would write
+	// SkipUntil "", and resuming would reprocess the whole whisperDir from
+	// scratch instead of resuming at a file it has already seen (files can
+	// finish out of walk order, so a few already-written files may be redone)
+	var lastFinished string
+
+	var checkpointTicker *time.Ticker
+	var checkpointTick <-chan time.Time
+	if checkpointFile != "" && checkpointInterval > 0 {
+		checkpointTicker = time.NewTicker(checkpointInterval)
+		checkpointTick = checkpointTicker.C
+		defer checkpointTicker.Stop()
+	}
+
+	writeCurrentCheckpoint := func() {
+		if checkpointFile == "" {
+			return
+		}
+		skip := lastFinished
+		if firstInProgress != nil {
+			skip = firstInProgress.Path
+		}
+		cp := checkpoint{
+			Timestamp:     time.Now(),
+			WhisperDir:    whisperDir,
+			Include:       include,
+			Exclude:       exclude,
+			SkipUntil:     skip,
+			FilesRead:     atomic.LoadUint64(&filesReadCounter),
+			PointsWritten: atomic.LoadUint64(&pointsWrittenCounter),
+		}
+		if err := writeCheckpoint(checkpointFile, cp); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to write checkpoint to '%s': %s\n", checkpointFile, err.Error())
+		}
+	}
+
+	stopping := false
+
 	for {
 		select {
 		case found := <-foundFiles:
@@ -100,7 +171,20 @@ func keepOrder() {
 				}
 				prev = cur
 			}
+			lastFinished = finished
+			atomic.AddUint64(&filesReadCounter, 1)
+		case <-checkpointTick:
+			writeCurrentCheckpoint()
+		case sig := <-sigChan:
+			if stopping {
+				continue
+			}
+			stopping = true
+			fmt.Println("received", sig, "- checkpointing and draining in-flight writes before exit")
+			writeCurrentCheckpoint()
+			close(stopWalk)
 		case code := <-exit:
+			writeCurrentCheckpoint()
 			if firstInProgress != nil {
 				fmt.Println("the next file that needed processing was", firstInProgress.Path, "you can resume from there")
 			}
@@ -109,51 +193,109 @@ func keepOrder() {
 	}
 }
 
+// influxWorker accumulates points from many abstractSerie values into a single
+// batch, flushing it to activeSink once influxBatchSize points have piled up,
+// and also on every tick of a fixed influxBatchInterval ticker (which is not
+// reset by size-triggered flushes). This keeps the per-round-trip cost of writing millions of small
+// whisper files bounded, instead of doing one write per file, regardless of
+// which -sink is in use.
 func influxWorker() {
-	for abstractSerie := range influxSeries {
-		influxPoints := make([]client.Point, len(abstractSerie.Points))
-		basename := strings.TrimSuffix(abstractSerie.Path[len(whisperDir)+1:], ".wsp")
-		name := strings.Replace(basename, "/", ".", -1)
-		// TODO: if there are no points, we can just break out
-		for i, abstractPoint := range abstractSerie.Points {
-			influxPoints[i] = client.Point{
-				Measurement: name,
-				Fields: map[string]interface{}{
-					"value": abstractPoint.Value,
-				},
-				Time: time.Unix(int64(abstractPoint.Timestamp), 0),
+	var batchPoints []seriesPoint
+	var batchPaths []string
+
+	flush := func() {
+		if len(batchPoints) == 0 {
+			// nothing to write, but files that yielded zero points (narrow
+			// -from/-until window, sparse series, ...) still need to be
+			// reported done, or keepOrder's checkpoint can never advance past them
+			for _, path := range batchPaths {
+				finishedFiles <- path
 			}
+			batchPaths = nil
+			return
 		}
-		influxBatchPoints := client.BatchPoints{
-			RetentionPolicy: "default",
-			Points:  influxPoints,
-			Database: influxDb,
-			Precision: "s",
-		}
-		pre := time.Now()
+		backoff := &Backoff{Min: retryMin, Max: retryMax, Factor: retryFactor, Jitter: true, MaxAttempts: retryAttempts}
 		for {
-			_, err := influxClient.Write(influxBatchPoints)
+			pre := time.Now()
+			var err error
+			if simulateFailureRate > 0 && rand.Float64() < simulateFailureRate {
+				err = fmt.Errorf("simulated failure injected by -simulateFailureRate")
+			} else {
+				err = activeSink.Write(batchPoints)
+			}
 			duration := time.Since(pre)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Failed to write %s: %s (operation took %v)\n", seriesString(&influxBatchPoints), err.Error(), duration)
-				if skipInfluxErrors {
-					time.Sleep(time.Duration(5) * time.Second) // give InfluxDB to recover
+				fmt.Fprintf(os.Stderr, "Failed to write %d points: %s (operation took %v)\n", len(batchPoints), err.Error(), duration)
+				if shouldRetry(err, retryOnClasses) && !backoff.Exhausted() {
+					time.Sleep(backoff.Duration())
 					continue
-				} else {
-					exit <- 2
-					time.Sleep(time.Duration(100) * time.Second) // give other things chance to complete, and program to exit, without printing "committed"
 				}
+				if skipInfluxErrors {
+					fmt.Fprintf(os.Stderr, "giving up on batch of %d points, dropping it\n", len(batchPoints))
+					influxWriteDropped.Inc(1)
+					// the batch is lost, but the paths are done as far as keepOrder is concerned
+					for _, path := range batchPaths {
+						finishedFiles <- path
+					}
+					break
+				}
+				exit <- 2
+				time.Sleep(time.Duration(100) * time.Second) // give other things chance to complete, and program to exit, without printing "committed"
 			}
 			if verbose {
-				fmt.Println("committed", seriesString(&influxBatchPoints))
+				fmt.Println("committed", len(batchPoints), "points")
 			}
 			influxWriteTimer.Update(duration)
-			finishedFiles <- abstractSerie.Path
+			atomic.AddUint64(&pointsWrittenCounter, uint64(len(batchPoints)))
+			// only now that the batch is acknowledged can we tell keepOrder these paths are done,
+			// so -skipUntil resume semantics stay correct even though writes are batched across files
+			for _, path := range batchPaths {
+				finishedFiles <- path
+			}
 			break
 		}
+		batchPoints = nil
+		batchPaths = nil
+	}
 
+	ticker := time.NewTicker(influxBatchInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case abstractSerie, ok := <-influxSeries:
+			if !ok {
+				flush()
+				influxWorkersWg.Done()
+				return
+			}
+			basename := strings.TrimSuffix(abstractSerie.Path[len(whisperDir)+1:], ".wsp")
+			name := strings.Replace(basename, "/", ".", -1)
+			// templating happens once per file, not per point: every point from
+			// this file gets the same measurement name and tags
+			measurement, tags := matchTemplate(name, graphiteTemplates)
+			for key, value := range defaultTags {
+				if _, overridden := tags[key]; !overridden {
+					tags[key] = value
+				}
+			}
+			for _, abstractPoint := range abstractSerie.Points {
+				batchPoints = append(batchPoints, seriesPoint{
+					Measurement: measurement,
+					Tags:        tags,
+					Field:       fieldName,
+					Value:       abstractPoint.Value,
+					Time:        time.Unix(int64(abstractPoint.Timestamp), 0),
+				})
+			}
+			batchPaths = append(batchPaths, abstractSerie.Path)
+			if len(batchPoints) >= influxBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
 	}
-	influxWorkersWg.Done()
 }
 
 type abstractSerie struct {
@@ -161,6 +303,52 @@ type abstractSerie struct {
 	Points []whisper.Point
 }
 
+// dedupArchives walks a whisper file's archives from highest to lowest resolution
+// (index 0 is always the highest-resolution archive) and returns each distinct
+// timestamp exactly once, preferring the value from the highest-resolution archive
+// that covers it. This avoids shipping every low-res point over the wire and
+// relying on InfluxDB to overwrite it later with the high-res one.
+func dedupArchives(w *whisper.Whisper, path string) []whisper.Point {
+	pointsByTs := make(map[uint32]whisper.Point)
+	var earliestSeen uint32
+	for i := range w.Header.Archives {
+		allPoints, err := w.DumpArchive(i)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to read archive %d in '%s', skipping: %s\n", i, path, err.Error())
+			if skipWhisperErrors {
+				continue
+			} else {
+				exit <- 2
+			}
+		}
+		var archiveEarliest uint32
+		for _, point := range allPoints {
+			// we have to filter out the "None" records (where we didn't fill in data) explicitly here!
+			if point.Timestamp == 0 {
+				continue
+			}
+			if earliestSeen == 0 || point.Timestamp < earliestSeen {
+				pointsByTs[point.Timestamp] = point
+				if archiveEarliest == 0 || point.Timestamp < archiveEarliest {
+					archiveEarliest = point.Timestamp
+				}
+			}
+		}
+		if archiveEarliest != 0 {
+			earliestSeen = archiveEarliest
+		}
+	}
+
+	points := make([]whisper.Point, 0, len(pointsByTs))
+	for _, point := range pointsByTs {
+		points = append(points, point)
+	}
+	sort.Slice(points, func(i, j int) bool {
+		return points[i].Timestamp < points[j].Timestamp
+	})
+	return points
+}
+
 func whisperWorker() {
 	for path := range whisperFiles {
 		fd, err := os.Open(path)
@@ -185,7 +373,10 @@ func whisperWorker() {
 
 		var duration time.Duration
 		var points []whisper.Point
-		if all {
+		if all && allDedup {
+			points = dedupArchives(w, path)
+			duration = time.Since(pre)
+		} else if all {
 			numTotalPoints := uint32(0)
 			for i := range w.Header.Archives {
 				numTotalPoints += w.Header.Archives[i].Points
@@ -237,6 +428,11 @@ func whisperWorker() {
 }
 
 func process(path string, info os.FileInfo, err error) error {
+	select {
+	case <-stopWalk:
+		return errStopWalk
+	default:
+	}
 	// skipuntil can be "", in normal operation, or because we resumed operation.
 	// if it's != "", it means user requested skipping and we haven't hit that entry yet
 	if path == skipUntil {
@@ -272,11 +468,14 @@ func init() {
 	foundFiles = make(chan string)
 	finishedFiles = make(chan string)
 	exit = make(chan int)
+	stopWalk = make(chan struct{})
 
 	whisperReadTimer = metrics.NewTimer()
 	influxWriteTimer = metrics.NewTimer()
+	influxWriteDropped = metrics.NewCounter()
 	metrics.Register("whisper_read", whisperReadTimer)
 	metrics.Register("influx_write", influxWriteTimer)
+	metrics.Register("influx_write_dropped", influxWriteDropped)
 }
 
 func main() {
@@ -293,37 +492,65 @@ func main() {
 	flag.StringVar(&influxUser, "influxUser", "graphite", "influxdb user")
 	flag.StringVar(&influxPass, "influxPass", "graphite", "influxdb pass")
 	flag.StringVar(&influxDb, "influxDb", "graphite", "influxdb database")
+	flag.StringVar(&sinkKind, "sink", "influxdb", "output backend to write to: influxdb, prom-remote-write, or file-linewriter")
+	flag.StringVar(&promRemoteWriteURL, "promRemoteWriteURL", "", "URL of the Prometheus remote-write endpoint (required when -sink=prom-remote-write)")
+	flag.StringVar(&promRemoteWriteBearerToken, "promRemoteWriteBearerToken", "", "bearer token to authenticate with the remote-write endpoint")
+	flag.StringVar(&promRemoteWriteUser, "promRemoteWriteUser", "", "basic auth user for the remote-write endpoint (ignored if a bearer token is set)")
+	flag.StringVar(&promRemoteWritePass, "promRemoteWritePass", "", "basic auth password for the remote-write endpoint")
+	flag.StringVar(&fileLineWriterPath, "fileLineWriterPath", "", "file to write lines to when -sink=file-linewriter (\"\" or \"-\" means stdout)")
+	flag.StringVar(&fileLineWriterFormat, "fileLineWriterFormat", "influx", "line format to use when -sink=file-linewriter: influx or prometheus")
+	flag.IntVar(&influxBatchSize, "influxBatchPoints", 5000, "flush an influxdb write once this many points have accumulated across files")
+	flag.DurationVar(&influxBatchInterval, "influxBatchInterval", 2*time.Second, "flush an influxdb write at least this often, even if influxBatchPoints hasn't been reached")
+	flag.StringVar(&influxPrecision, "influxPrecision", "s", "timestamp precision to use for influxdb writes (s|ms|us|ns)")
+	flag.StringVar(&influxRetentionPolicy, "influxRetentionPolicy", "default", "retention policy to use for influxdb writes")
+	flag.DurationVar(&retryMin, "retryMin", 500*time.Millisecond, "minimum backoff delay before retrying a failed influxdb write")
+	flag.DurationVar(&retryMax, "retryMax", 30*time.Second, "maximum backoff delay before retrying a failed influxdb write")
+	flag.Float64Var(&retryFactor, "retryFactor", 2, "multiplier applied to the backoff delay after each failed attempt")
+	flag.IntVar(&retryAttempts, "retryAttempts", 10, "give up retrying an influxdb write after this many attempts (0 means retry forever)")
+	flag.StringVar(&retryOn, "retryOn", "5xx,network", "comma separated list of error classes to retry with backoff (5xx,network). 4xx errors are never retried")
+	flag.Float64Var(&simulateFailureRate, "simulateFailureRate", 0, "probability (0-1) of injecting a synthetic influxdb write failure, to validate retry/skip behaviour")
 	flag.StringVar(&skipUntil, "skipUntil", "", "absolute path of a whisper file from which to resume processing")
+	flag.StringVar(&checkpointFile, "checkpointFile", "", "periodically write progress here, so a crashed or killed run can be resumed automatically via -skipUntil")
+	flag.DurationVar(&checkpointInterval, "checkpointInterval", 30*time.Second, "how often to write -checkpointFile")
 	flag.StringVar(&influxPrefix, "influxPrefix", "", "prefix this string to all imported data")
+	flag.Var(&graphiteTemplates, "template", "graphite-style template (repeatable) mapping dotted metric names to a measurement and tags, e.g. \"servers.* host.resource.measurement*\". Matched in order; first match wins")
+	flag.StringVar(&defaultTagsSpec, "defaultTags", "", "comma separated key=value tags merged into every point, e.g. \"datacenter=ams,env=prod\"")
+	flag.StringVar(&fieldName, "fieldName", "value", "field name to store the whisper value under")
 	flag.StringVar(&include, "include", "", "only process whisper files whose filename contains this string (\"\" is a no-op, and matches everything")
 	flag.StringVar(&exclude, "exclude", "", "don't process whisper files whose filename contains this string (\"\" disables the filter, and matches nothing")
 	flag.BoolVar(&verbose, "verbose", false, "verbose output")
 	flag.BoolVar(&all, "all", false, "copy all data from all archives, as opposed to just querying the timerange from the best archive")
+	flag.BoolVar(&allDedup, "allDedup", false, "when used with -all, walk archives from highest to lowest resolution and send each timestamp only once, instead of shipping every low-res point and relying on InfluxDB to overwrite it later")
 	flag.BoolVar(&skipInfluxErrors, "skipInfluxErrors", false, "when an influxdb write fails, skip to the next one istead of failing")
 	flag.BoolVar(&skipWhisperErrors, "skipWhisperErrors", false, "when a whisper read fails, skip to the next one instead of failing")
 	flag.UintVar(&statsInterval, "statsInterval", 10, "interval to display stats. by default 10 seconds.")
 
 	flag.Parse()
 
+	retryOnClasses = parseRetryOn(retryOn)
+	defaultTags = parseDefaultTags(defaultTagsSpec)
+
 	if strings.HasSuffix(whisperDir, "/") {
 		whisperDir = whisperDir[:len(whisperDir)-1]
 	}
 	fromTime = uint32(from)
 	untilTime = uint32(until)
 
-	server_url, url_err := url.Parse(fmt.Sprintf("http://%s:%d", influxHost, influxPort))
-	if url_err != nil {
-		log.Fatal(url_err)
-	}
-
-	cfg := &client.Config{
-		URL:     *server_url,
-		Username: influxUser,
-		Password: influxPass,
+	skipUntilSetExplicitly := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "skipUntil" {
+			skipUntilSetExplicitly = true
+		}
+	})
+	if checkpointFile != "" && !skipUntilSetExplicitly {
+		if cp, err := readCheckpoint(checkpointFile); err == nil && cp.SkipUntil != "" && cp.matches(whisperDir, include, exclude) {
+			skipUntil = cp.SkipUntil
+			fmt.Printf("resuming from checkpoint '%s': skipping until '%s'\n", checkpointFile, skipUntil)
+		}
 	}
 
 	var err error
-	influxClient, err = client.NewClient(*cfg)
+	activeSink, err = newSink(sinkKind)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -340,10 +567,12 @@ func main() {
 		go whisperWorker()
 	}
 
-	go keepOrder()
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	go keepOrder(sigChan)
 
 	err = filepath.Walk(whisperDir, process)
-	if err != nil {
+	if err != nil && err != errStopWalk {
 		fmt.Fprintln(os.Stderr, err.Error())
 		exit <- 2
 	}
@@ -360,6 +589,9 @@ func main() {
 		fmt.Println("waiting for influxworkers to finish")
 	}
 	influxWorkersWg.Wait()
+	if err := activeSink.Close(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to close sink: %s\n", err.Error())
+	}
 	if verbose {
 		fmt.Println("all done. exiting")
 	}